@@ -30,16 +30,88 @@ import (
 //
 // It also creates <module>-api.<scope>.latest for the lastest <ver>.
 //
+// When combined_latest_scopes lists a scope, it additionally creates a
+// combined-latest.<scope> filegroup whose srcs reference the <module>.api.<scope>.latest
+// filegroup of every module, so that the whole API surface for that scope can be
+// depended on via a single module reference.
+//
+// An API directory may also contain <module>-removed.txt, <module>-incompatibilities.txt
+// and <module>-last-released.txt files alongside <module>.txt; these produce filegroups
+// named <module>-removed.api.<scope>.<ver>, <module>-incompatibilities.api.<scope>.<ver>
+// and <module>-last-released.api.<scope>.<ver> respectively (and their "latest" variants).
+// Any module implementing LatestApiCheckUser has its checkapi baselines wired up to the
+// "latest" incompatibilities/removed filegroups automatically; no module type in this tree
+// implements it yet (see LatestApiCheckUser).
 func init() {
 	android.RegisterModuleType("prebuilt_apis", prebuiltApisFactory)
 
 	android.PreArchMutators(func(ctx android.RegisterMutatorsContext) {
 		ctx.TopDown("prebuilt_apis", prebuiltApisMutator).Parallel()
+		ctx.BottomUp("prebuilt_apis_sdk_version", resolvePrebuiltSdkVersionMutator).Parallel()
+		ctx.BottomUp("prebuilt_apis_check_api", resolveLatestApiCheckMutator).Parallel()
+	})
+
+	RegisterPrebuiltApiScope("public", PrebuiltApiScopeInfo{
+		SdkVersionPrefix: "",
+		CurrentStubs:     "android_stubs_current",
+	})
+	RegisterPrebuiltApiScope("system", PrebuiltApiScopeInfo{
+		SdkVersionPrefix: "system_",
+		CurrentStubs:     "android_system_stubs_current",
+	})
+	RegisterPrebuiltApiScope("test", PrebuiltApiScopeInfo{
+		SdkVersionPrefix: "test_",
+		CurrentStubs:     "android_test_stubs_current",
+	})
+	RegisterPrebuiltApiScope("core", PrebuiltApiScopeInfo{
+		SdkVersionPrefix: "core_",
+		CurrentStubs:     "core.current.stubs",
+	})
+	RegisterPrebuiltApiScope("module-lib", PrebuiltApiScopeInfo{
+		SdkVersionPrefix: "module_",
+		CurrentStubs:     "android_module_lib_stubs_current",
 	})
+	RegisterPrebuiltApiScope("system-server", PrebuiltApiScopeInfo{
+		SdkVersionPrefix: "system_server_",
+		CurrentStubs:     "android_system_server_stubs_current",
+	})
+}
+
+// PrebuiltApiScopeInfo describes how a prebuilt_apis scope (e.g. "public", "module-lib")
+// is mapped onto the java build: the sdk_version prefix that selects this scope (e.g.
+// "system_" so that sdk_version: "system_28" resolves to scope "system", apiver "28"), and
+// the module providing the scope's "current" stubs.
+type PrebuiltApiScopeInfo struct {
+	SdkVersionPrefix string
+	CurrentStubs     string
+}
+
+// sdkVersion returns the sdk_version value to give a java_import generated for a prebuilt
+// jar in this scope, e.g. "system_current" for scope "system".
+func (info PrebuiltApiScopeInfo) sdkVersion() string {
+	return info.SdkVersionPrefix + "current"
+}
+
+// prebuiltApiScopes is the registry of scopes that prebuilt_apis recognizes under its
+// <ver>/<scope>/ directories. Other packages can add to it via RegisterPrebuiltApiScope
+// instead of prebuilt_apis hardcoding every API surface Mainline modules may need.
+var prebuiltApiScopes = map[string]PrebuiltApiScopeInfo{}
+
+// RegisterPrebuiltApiScope adds scope to the set of scopes prebuilt_apis recognizes.
+func RegisterPrebuiltApiScope(scope string, info PrebuiltApiScopeInfo) {
+	prebuiltApiScopes[scope] = info
+}
+
+type prebuiltApisProperties struct {
+	// list of scopes to combine the latest API files of all modules into
+	// a single "combined-latest.<scope>" filegroup, e.g. ["public", "system"].
+	Combined_latest_scopes []string
 }
 
 type prebuiltApis struct {
 	android.ModuleBase
+
+	properties prebuiltApisProperties
 }
 
 func (module *prebuiltApis) DepsMutator(ctx android.BottomUpMutatorContext) {
@@ -55,8 +127,8 @@ func parseJarPath(ctx android.BaseModuleContext, path string) (module string, ap
 
 	apiver = elements[0]
 	scope = elements[1]
-	if scope != "public" && scope != "system" && scope != "test" && scope != "core" {
-		// scope must be public, system or test
+	if _, ok := prebuiltApiScopes[scope]; !ok {
+		// scope must be registered in prebuiltApiScopes
 		return
 	}
 
@@ -64,7 +136,16 @@ func parseJarPath(ctx android.BaseModuleContext, path string) (module string, ap
 	return
 }
 
-func parseApiFilePath(ctx android.BaseModuleContext, path string) (module string, apiver int, scope string) {
+// apiFileKindSuffixes maps the "-<suffix>.txt" part of an api file name to the kind of
+// filegroup it should produce, e.g. "android-removed.txt" produces a "removed" filegroup
+// alongside the "api" filegroup for "android.txt" itself.
+var apiFileKindSuffixes = map[string]string{
+	"-removed":           "removed",
+	"-incompatibilities": "incompatibilities",
+	"-last-released":     "last-released",
+}
+
+func parseApiFilePath(ctx android.BaseModuleContext, path string) (module string, apiver int, scope string, kind string) {
 	elements := strings.Split(path, "/")
 	ver, err := strconv.Atoi(elements[0])
 	if err != nil {
@@ -74,16 +155,30 @@ func parseApiFilePath(ctx android.BaseModuleContext, path string) (module string
 	apiver = ver
 
 	scope = elements[1]
-	if scope != "public" && scope != "system" && scope != "test" {
+	if _, ok := prebuiltApiScopes[scope]; !ok {
 		ctx.ModuleErrorf("invalid scope %q found in path: %q", scope, path)
 		return
 	}
 
 	// elements[2] is string literal "api". skipping.
-	module = strings.TrimSuffix(elements[3], ".txt")
+	name := strings.TrimSuffix(elements[3], ".txt")
+	module, kind = splitApiFileName(name)
 	return
 }
 
+// splitApiFileName splits the basename of an api txt file (with ".txt" already stripped)
+// into the module it describes and the kind of filegroup it should produce, e.g.
+// "android-removed" splits into module "android", kind "removed", while "android" itself
+// splits into module "android", kind "api".
+func splitApiFileName(name string) (module string, kind string) {
+	for suffix, k := range apiFileKindSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), k
+		}
+	}
+	return name, "api"
+}
+
 func createImport(mctx android.TopDownMutatorContext, module string, scope string, apiver string, path string) {
 	props := struct {
 		Name        *string
@@ -93,15 +188,17 @@ func createImport(mctx android.TopDownMutatorContext, module string, scope strin
 	}{}
 	props.Name = proptools.StringPtr("sdk_" + scope + "_" + apiver + "_" + module)
 	props.Jars = append(props.Jars, path)
-	// TODO(hansson): change to scope after migration is done.
-	props.Sdk_version = proptools.StringPtr("current")
+	props.Sdk_version = proptools.StringPtr(prebuiltApiScopes[scope].sdkVersion())
 	props.Installable = proptools.BoolPtr(false)
 
 	mctx.CreateModule(android.ModuleFactoryAdaptor(ImportFactory), &props)
 }
 
-func createFilegroup(mctx android.TopDownMutatorContext, module string, scope string, apiver string, path string) {
+func createFilegroup(mctx android.TopDownMutatorContext, module string, scope string, apiver string, kind string, path string) {
 	fgName := module + ".api." + scope + "." + apiver
+	if kind != "api" {
+		fgName = module + "-" + kind + ".api." + scope + "." + apiver
+	}
 	filegroupProps := struct {
 		Name *string
 		Srcs []string
@@ -111,7 +208,183 @@ func createFilegroup(mctx android.TopDownMutatorContext, module string, scope st
 	mctx.CreateModule(android.ModuleFactoryAdaptor(android.FileGroupFactory), &filegroupProps)
 }
 
-func prebuiltSdkStubs(mctx android.TopDownMutatorContext) {
+// UseBuiltSdkPrebuilts returns true if this build should resolve sdk_version against the
+// prebuilt stub jars generated by prebuilt_apis rather than building the framework stubs
+// from source. This is the case for unbundled app builds (TARGET_BUILD_APPS is non-empty)
+// unless UNBUNDLED_BUILD_SDKS_FROM_SOURCE is set, which forces building the stubs from source
+// even in an unbundled tree (e.g. for sdk stub generation itself).
+func UseBuiltSdkPrebuilts(ctx android.BaseModuleContext) bool {
+	return ctx.Config().UnbundledBuildUsePrebuiltSdks()
+}
+
+// PrebuiltJars returns the module reference (e.g. ":sdk_system_28_android") of the prebuilt
+// stub jar generated by prebuilt_apis for module at the given scope and API level, for use as
+// a java_import dependency when sdk_version pins to something other than "current".
+//
+// If apiver is "current", the sdk_<scope>_current_<module> prebuilt is returned when
+// UseBuiltSdkPrebuilts is true and that prebuilt exists; otherwise the per-scope current stubs
+// module is returned. If no prebuilt exists for a numbered apiver, PrebuiltJars falls back to
+// the next older API level that does, and finally to the current stubs for the scope if no
+// numbered prebuilt is found at all.
+func PrebuiltJars(ctx android.BaseModuleContext, module string, scope string, apiver string) []string {
+	info, ok := prebuiltApiScopes[scope]
+	if !ok {
+		ctx.ModuleErrorf("unrecognized prebuilt api scope %q", scope)
+		return nil
+	}
+
+	if apiver == "current" {
+		if UseBuiltSdkPrebuilts(ctx) {
+			name := "sdk_" + scope + "_current_" + module
+			if ctx.OtherModuleExists(name) {
+				return []string{":" + name}
+			}
+		}
+		return []string{":" + info.CurrentStubs}
+	}
+
+	ver, err := strconv.Atoi(apiver)
+	if err != nil {
+		ctx.ModuleErrorf("invalid sdk version %q for scope %q", apiver, scope)
+		return nil
+	}
+
+	if name, ok := choosePrebuiltApiLevel(ctx.OtherModuleExists, scope, module, ver); ok {
+		return []string{":" + name}
+	}
+
+	// nothing numbered was found; fall back to the current stubs for the scope.
+	return []string{":" + info.CurrentStubs}
+}
+
+// choosePrebuiltApiLevel returns the name of the prebuilt sdk_<scope>_<v>_<module> import for
+// the newest v <= ver for which exists(name) is true, or "", false if none exists.
+func choosePrebuiltApiLevel(exists func(name string) bool, scope string, module string, ver int) (string, bool) {
+	for v := ver; v > 0; v-- {
+		name := "sdk_" + scope + "_" + strconv.Itoa(v) + "_" + module
+		if exists(name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// ParseSdkVersion splits a module's sdk_version string (e.g. "system_28", "module_current",
+// "current", "") into the prebuilt_apis scope and API level it selects. It returns ok=false
+// if sdkVersion does not match any registered scope's prefix.
+func ParseSdkVersion(sdkVersion string) (scope string, apiver string, ok bool) {
+	if sdkVersion == "" || sdkVersion == "current" {
+		return "public", "current", true
+	}
+
+	// match the longest registered prefix first, since e.g. "system_server_" is itself
+	// prefixed by "system_".
+	var prefixes []string
+	for s := range prebuiltApiScopes {
+		prefixes = append(prefixes, s)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prebuiltApiScopes[prefixes[i]].SdkVersionPrefix) > len(prebuiltApiScopes[prefixes[j]].SdkVersionPrefix)
+	})
+
+	for _, s := range prefixes {
+		prefix := prebuiltApiScopes[s].SdkVersionPrefix
+		if prefix != "" && strings.HasPrefix(sdkVersion, prefix) {
+			return s, strings.TrimPrefix(sdkVersion, prefix), true
+		}
+	}
+	return "", "", false
+}
+
+// PrebuiltSdkVersionUser is the extension point a java module type implements to have its
+// sdk_version resolved against the prebuilt stub jars generated by prebuilt_apis instead of
+// the framework stubs built from source. No module type in this tree implements it yet; this
+// interface and resolvePrebuiltSdkVersionMutator are plumbing for a follow-up change that adds
+// the implementation to java_library/java_sdk_library.
+type PrebuiltSdkVersionUser interface {
+	android.Module
+
+	// SdkVersion returns the module's sdk_version property value.
+	SdkVersion() string
+	// PrebuiltSdkModule returns the base module name (e.g. "android") whose prebuilt stub
+	// jars should be used to satisfy SdkVersion().
+	PrebuiltSdkModule() string
+	// SetPrebuiltSdkJars is called with the resolved prebuilt jar labels to depend on. It is
+	// not called when the module keeps resolving its sdk_version the normal, non-prebuilt way,
+	// and is called with nil after an error has been reported for an invalid sdk_version.
+	SetPrebuiltSdkJars(jars []string)
+}
+
+// resolvePrebuiltSdkVersionMutator resolves sdk_version against prebuilt_apis-generated jars
+// for any module implementing PrebuiltSdkVersionUser: always for an explicit non-current
+// sdk_version (e.g. "system_28"), and for "current"/unset sdk_version only when the build is
+// pinned to prebuilts, i.e. UseBuiltSdkPrebuilts returns true (unbundled app builds unless
+// UNBUNDLED_BUILD_SDKS_FROM_SOURCE overrides it). Until a module type implements
+// PrebuiltSdkVersionUser, this is a no-op.
+func resolvePrebuiltSdkVersionMutator(ctx android.BottomUpMutatorContext) {
+	m, ok := ctx.Module().(PrebuiltSdkVersionUser)
+	if !ok {
+		return
+	}
+
+	sdkVersion := m.SdkVersion()
+	if (sdkVersion == "" || sdkVersion == "current") && !UseBuiltSdkPrebuilts(ctx) {
+		return
+	}
+
+	scope, apiver, ok := ParseSdkVersion(sdkVersion)
+	if !ok {
+		ctx.ModuleErrorf("unrecognized sdk_version %q", sdkVersion)
+		return
+	}
+
+	m.SetPrebuiltSdkJars(PrebuiltJars(ctx, m.PrebuiltSdkModule(), scope, apiver))
+}
+
+// LatestApiCheckLabels returns the filegroup labels of the most recently released API
+// surface for module at scope, for java_sdk_library to wire up as its checkapi baselines:
+// baseline is the "new API" comparison point (the incompatibilities filegroup) and removed
+// is the set of APIs that are allowed to have been removed since that release.
+func LatestApiCheckLabels(module string, scope string) (baseline string, removed string) {
+	baseline = ":" + module + "-incompatibilities.api." + scope + ".latest"
+	removed = ":" + module + "-removed.api." + scope + ".latest"
+	return
+}
+
+// LatestApiCheckUser is the extension point a java module type implements so that its
+// checkapi baselines are wired up automatically from the prebuilt_apis-generated filegroups,
+// without needing to set check_api.* labels by hand in every Android.bp. No module type in
+// this tree implements it yet; this interface and resolveLatestApiCheckMutator are plumbing
+// for a follow-up change that adds the implementation to java_sdk_library.
+type LatestApiCheckUser interface {
+	android.Module
+
+	// CheckApiModule returns the base module name (e.g. "android") whose latest released API
+	// surface this module's current API should be checked against.
+	CheckApiModule() string
+	// CheckApiScope returns the api scope (e.g. "public") to check against.
+	CheckApiScope() string
+	// SetCheckApiBaselines is called with the resolved incompatibilities and removed-api
+	// filegroup labels for CheckApiModule()/CheckApiScope().
+	SetCheckApiBaselines(baseline string, removed string)
+}
+
+// resolveLatestApiCheckMutator sets the checkapi baselines on any module implementing
+// LatestApiCheckUser to the latest released incompatibilities/removed-api filegroups for its
+// CheckApiModule()/CheckApiScope(), so `m checkapi` compares against the newest released
+// surface without manual wiring in every Android.bp. Until a module type implements
+// LatestApiCheckUser, this is a no-op.
+func resolveLatestApiCheckMutator(ctx android.BottomUpMutatorContext) {
+	m, ok := ctx.Module().(LatestApiCheckUser)
+	if !ok {
+		return
+	}
+
+	baseline, removed := LatestApiCheckLabels(m.CheckApiModule(), m.CheckApiScope())
+	m.SetCheckApiBaselines(baseline, removed)
+}
+
+func prebuiltSdkStubs(mctx android.TopDownMutatorContext, p *prebuiltApis) {
 	mydir := mctx.ModuleDir() + "/"
 	// <apiver>/<scope>/<module>.jar
 	files, err := mctx.GlobWithDeps(mydir+"*/*/*.jar", nil)
@@ -133,7 +406,26 @@ func prebuiltSdkStubs(mctx android.TopDownMutatorContext) {
 	}
 }
 
-func prebuiltApiFiles(mctx android.TopDownMutatorContext) {
+// createCombinedFilegroup creates a filegroup named "combined-latest.<scope>" whose srcs
+// reference the per-module "latest" filegroups (":<module>.api.<scope>.latest") of every
+// module that has one for the given scope, so that consumers can depend on the whole API
+// surface for a scope without having to enumerate every module.
+func createCombinedFilegroup(mctx android.TopDownMutatorContext, scope string, modules []string) {
+	fgName := "combined-latest." + scope
+	srcs := make([]string, len(modules))
+	for i, module := range modules {
+		srcs[i] = ":" + module + ".api." + scope + ".latest"
+	}
+	filegroupProps := struct {
+		Name *string
+		Srcs []string
+	}{}
+	filegroupProps.Name = proptools.StringPtr(fgName)
+	filegroupProps.Srcs = srcs
+	mctx.CreateModule(android.ModuleFactoryAdaptor(android.FileGroupFactory), &filegroupProps)
+}
+
+func prebuiltApiFiles(mctx android.TopDownMutatorContext, p *prebuiltApis) {
 	mydir := mctx.ModuleDir() + "/"
 	// <apiver>/<scope>/api/<module>.txt
 	files, err := mctx.GlobWithDeps(mydir+"*/*/api/*.txt", nil)
@@ -145,10 +437,11 @@ func prebuiltApiFiles(mctx android.TopDownMutatorContext) {
 	}
 
 	// construct a map to find out the latest api file path
-	// for each (<module>, <scope>) pair.
+	// for each (<module>, <scope>, <kind>) tuple.
 	type latestApiInfo struct {
 		module string
 		scope  string
+		kind   string
 		apiver int
 		path   string
 	}
@@ -157,17 +450,18 @@ func prebuiltApiFiles(mctx android.TopDownMutatorContext) {
 	for _, f := range files {
 		// create a filegroup for each api txt file
 		localPath := strings.TrimPrefix(f, mydir)
-		module, apiver, scope := parseApiFilePath(mctx, localPath)
-		createFilegroup(mctx, module, scope, strconv.Itoa(apiver), localPath)
+		module, apiver, scope, kind := parseApiFilePath(mctx, localPath)
+		createFilegroup(mctx, module, scope, strconv.Itoa(apiver), kind, localPath)
 
 		// find the latest apiver
-		key := module + "." + scope
+		key := module + "." + scope + "." + kind
 		info, ok := m[key]
 		if !ok {
-			m[key] = latestApiInfo{module, scope, apiver, localPath}
+			m[key] = latestApiInfo{module, scope, kind, apiver, localPath}
 		} else if apiver > info.apiver {
 			info.apiver = apiver
 			info.path = localPath
+			m[key] = info
 		}
 	}
 	// create filegroups for the latest version of (<module>, <scope>) pairs
@@ -177,21 +471,61 @@ func prebuiltApiFiles(mctx android.TopDownMutatorContext) {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
+
+	// collect, per combined_latest_scopes entry, the list of modules that have a
+	// "latest" filegroup for that scope, so a single combined filegroup can be
+	// created spanning all of them.
+	combinedLatestScopes := dedupCombinedLatestScopes(mctx, p.properties.Combined_latest_scopes)
+	combinedScopes := make(map[string]bool)
+	for _, scope := range combinedLatestScopes {
+		combinedScopes[scope] = true
+	}
+	modulesByScope := make(map[string][]string)
+
 	for _, k := range keys {
 		info := m[k]
-		createFilegroup(mctx, info.module, info.scope, "latest", info.path)
+		createFilegroup(mctx, info.module, info.scope, "latest", info.kind, info.path)
+		if info.kind == "api" && combinedScopes[info.scope] {
+			modulesByScope[info.scope] = append(modulesByScope[info.scope], info.module)
+		}
+	}
+
+	for _, scope := range combinedLatestScopes {
+		createCombinedFilegroup(mctx, scope, modulesByScope[scope])
+	}
+}
+
+// dedupCombinedLatestScopes validates that every entry in combinedLatestScopes is a
+// registered prebuilt_apis scope, reporting a property error on the ones that aren't, and
+// drops duplicate entries so createCombinedFilegroup is never asked to create the same
+// combined-latest.<scope> module twice.
+func dedupCombinedLatestScopes(mctx android.TopDownMutatorContext, combinedLatestScopes []string) []string {
+	seen := make(map[string]bool)
+	scopes := make([]string, 0, len(combinedLatestScopes))
+	for _, scope := range combinedLatestScopes {
+		if _, ok := prebuiltApiScopes[scope]; !ok {
+			mctx.PropertyErrorf("combined_latest_scopes", "unrecognized scope %q", scope)
+			continue
+		}
+		if seen[scope] {
+			continue
+		}
+		seen[scope] = true
+		scopes = append(scopes, scope)
 	}
+	return scopes
 }
 
 func prebuiltApisMutator(mctx android.TopDownMutatorContext) {
-	if _, ok := mctx.Module().(*prebuiltApis); ok {
-		prebuiltApiFiles(mctx)
-		prebuiltSdkStubs(mctx)
+	if p, ok := mctx.Module().(*prebuiltApis); ok {
+		prebuiltApiFiles(mctx, p)
+		prebuiltSdkStubs(mctx, p)
 	}
 }
 
 func prebuiltApisFactory() android.Module {
 	module := &prebuiltApis{}
+	module.AddProperties(&module.properties)
 	android.InitAndroidModule(module)
 	return module
 }
@@ -0,0 +1,133 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"testing"
+
+	"android/soong/android"
+)
+
+// fakePropertyErrorfContext is a android.TopDownMutatorContext that only supports
+// PropertyErrorf, for testing functions that don't use the rest of the interface.
+type fakePropertyErrorfContext struct {
+	android.TopDownMutatorContext
+	errors []string
+}
+
+func (ctx *fakePropertyErrorfContext) PropertyErrorf(property, format string, args ...interface{}) {
+	ctx.errors = append(ctx.errors, property)
+}
+
+func TestParseSdkVersion(t *testing.T) {
+	tests := []struct {
+		sdkVersion string
+		scope      string
+		apiver     string
+		ok         bool
+	}{
+		{"", "public", "current", true},
+		{"current", "public", "current", true},
+		{"system_28", "system", "28", true},
+		{"system_current", "system", "current", true},
+		{"test_current", "test", "current", true},
+		{"core_current", "core", "current", true},
+		{"module_current", "module-lib", "current", true},
+		{"system_server_28", "system-server", "28", true},
+		{"system_server_current", "system-server", "current", true},
+		{"bogus_current", "", "", false},
+	}
+	for _, tt := range tests {
+		scope, apiver, ok := ParseSdkVersion(tt.sdkVersion)
+		if scope != tt.scope || apiver != tt.apiver || ok != tt.ok {
+			t.Errorf("ParseSdkVersion(%q) = (%q, %q, %v), want (%q, %q, %v)",
+				tt.sdkVersion, scope, apiver, ok, tt.scope, tt.apiver, tt.ok)
+		}
+	}
+}
+
+func TestChoosePrebuiltApiLevel(t *testing.T) {
+	exists := map[string]bool{
+		"sdk_system_28_android": true,
+		"sdk_system_26_android": true,
+	}
+	tests := []struct {
+		ver      int
+		wantName string
+		wantOk   bool
+	}{
+		{28, "sdk_system_28_android", true},
+		{29, "sdk_system_28_android", true}, // falls back to the newest v <= ver
+		{26, "sdk_system_26_android", true},
+		{25, "", false}, // nothing registered at or below 25
+	}
+	for _, tt := range tests {
+		name, ok := choosePrebuiltApiLevel(func(n string) bool { return exists[n] }, "system", "android", tt.ver)
+		if name != tt.wantName || ok != tt.wantOk {
+			t.Errorf("choosePrebuiltApiLevel(..., %d) = (%q, %v), want (%q, %v)",
+				tt.ver, name, ok, tt.wantName, tt.wantOk)
+		}
+	}
+}
+
+func TestSplitApiFileName(t *testing.T) {
+	tests := []struct {
+		name       string
+		wantModule string
+		wantKind   string
+	}{
+		{"android", "android", "api"},
+		{"android-removed", "android", "removed"},
+		{"android-incompatibilities", "android", "incompatibilities"},
+		{"android-last-released", "android", "last-released"},
+		{"framework-sdkext-removed", "framework-sdkext", "removed"},
+	}
+	for _, tt := range tests {
+		module, kind := splitApiFileName(tt.name)
+		if module != tt.wantModule || kind != tt.wantKind {
+			t.Errorf("splitApiFileName(%q) = (%q, %q), want (%q, %q)",
+				tt.name, module, kind, tt.wantModule, tt.wantKind)
+		}
+	}
+}
+
+func TestDedupCombinedLatestScopes(t *testing.T) {
+	ctx := &fakePropertyErrorfContext{}
+	got := dedupCombinedLatestScopes(ctx, []string{"public", "system", "public", "bogus"})
+
+	wantScopes := []string{"public", "system"}
+	if len(got) != len(wantScopes) {
+		t.Fatalf("dedupCombinedLatestScopes() = %v, want %v", got, wantScopes)
+	}
+	for i, scope := range wantScopes {
+		if got[i] != scope {
+			t.Errorf("dedupCombinedLatestScopes()[%d] = %q, want %q", i, got[i], scope)
+		}
+	}
+
+	if len(ctx.errors) != 1 || ctx.errors[0] != "combined_latest_scopes" {
+		t.Errorf("PropertyErrorf calls = %v, want one call on \"combined_latest_scopes\"", ctx.errors)
+	}
+}
+
+func TestLatestApiCheckLabels(t *testing.T) {
+	baseline, removed := LatestApiCheckLabels("android", "public")
+	wantBaseline := ":android-incompatibilities.api.public.latest"
+	wantRemoved := ":android-removed.api.public.latest"
+	if baseline != wantBaseline || removed != wantRemoved {
+		t.Errorf("LatestApiCheckLabels(\"android\", \"public\") = (%q, %q), want (%q, %q)",
+			baseline, removed, wantBaseline, wantRemoved)
+	}
+}